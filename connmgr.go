@@ -1,6 +1,7 @@
 package grpc_haclient
 
 import (
+	"context"
 	"errors"
 	"sort"
 	"sync"
@@ -9,26 +10,93 @@ import (
 	"google.golang.org/grpc"
 )
 
+// connState 包裹一个*grpc.ClientConn，记录它的in-flight请求数以及是否处于draining状态，
+// 并实现grpc.ClientConnInterface，以便在Invoke/NewStream前后透明地维护in-flight计数
+type connState struct {
+	cc       *grpc.ClientConn
+	inflight int64
+	draining int32 // 0表示正常对外提供服务，1表示draining，通过atomic读写
+}
+
+func newConnState(cc *grpc.ClientConn) *connState {
+	return &connState{cc: cc}
+}
+
+func (s *connState) Invoke(ctx context.Context, method string, args, reply interface{}, opts ...grpc.CallOption) error {
+	atomic.AddInt64(&s.inflight, 1)
+	defer atomic.AddInt64(&s.inflight, -1)
+	return s.cc.Invoke(ctx, method, args, reply, opts...)
+}
+
+func (s *connState) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	atomic.AddInt64(&s.inflight, 1)
+	stream, err := s.cc.NewStream(ctx, desc, method, opts...)
+	if err != nil {
+		atomic.AddInt64(&s.inflight, -1)
+		return nil, err
+	}
+	return &trackedStream{ClientStream: stream, onDone: func() { atomic.AddInt64(&s.inflight, -1) }}, nil
+}
+
+// InFlight 返回这个连接上当前正在进行中的请求数
+func (s *connState) InFlight() int64 {
+	return atomic.LoadInt64(&s.inflight)
+}
+
+func (s *connState) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+func (s *connState) setDraining(draining bool) {
+	var v int32
+	if draining {
+		v = 1
+	}
+	atomic.StoreInt32(&s.draining, v)
+}
+
+// trackedStream 包裹grpc.ClientStream，在流结束(RecvMsg返回非nil，通常是io.EOF)时
+// 回调onDone归还in-flight计数
+type trackedStream struct {
+	grpc.ClientStream
+	once   sync.Once
+	onDone func()
+}
+
+func (s *trackedStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil {
+		s.once.Do(s.onDone)
+	}
+	return err
+}
+
 type clientConnManager struct {
-	mutex             sync.RWMutex
-	connSet           map[string]*grpc.ClientConn // endpoint ==> *grpc.ClientConn
-	endpoints         []string                    // endpoints
-	lastRoundRobinIdx int32                       // 记录上次roundrobin的位置
+	mutex     sync.RWMutex
+	connSet   map[string]*connState // endpoint ==> *connState
+	endpoints []string              // endpoints
+	draining  int32                 // 0/1，通过atomic读写；一旦置1，ResetConn新建立的连接也会
+	// 立即继承draining状态，避免GracefulClose等待期间被keepalive重新拨号/AddEndpoint/
+	// resolver下发的新连接绕过draining标记继续对外提供服务
+
+	// rrPicker 是FirstAvailableConn/RoundRobinConn使用的内置轮询器，
+	// lastRoundRobinIdx原先存放在clientConnManager上，现在由RoundRobinPicker自己维护
+	rrPicker *RoundRobinPicker
 }
 
 func newClientConnManager() *clientConnManager {
 	return &clientConnManager{
-		connSet:           make(map[string]*grpc.ClientConn),
-		endpoints:         make([]string, 0),
-		lastRoundRobinIdx: -1,
+		connSet:   make(map[string]*connState),
+		endpoints: make([]string, 0),
+		rrPicker:  NewRoundRobinPicker(),
 	}
 }
 
 func (m *clientConnManager) CloseAll() {
 	m.mutex.Lock()
-	for _, cc := range m.connSet {
-		if cc != nil {
-			cc.Close()
+	for _, s := range m.connSet {
+		if s != nil {
+			s.cc.Close()
 		}
 	}
 	m.mutex.Unlock()
@@ -38,16 +106,29 @@ func (m *clientConnManager) ResetConn(endpoint string, cc *grpc.ClientConn) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	if oldConn, _ := m.connSet[endpoint]; oldConn != nil {
-		oldConn.Close()
+	old := m.connSet[endpoint]
+	switch {
+	case old != nil && old.cc == cc:
+		// 同一个底层连接对象(例如短暂的状态抖动后恢复)，保留已有的in-flight/draining状态
+	case cc != nil:
+		if old != nil {
+			old.cc.Close()
+		}
+		s := newConnState(cc)
+		s.setDraining(atomic.LoadInt32(&m.draining) == 1)
+		m.connSet[endpoint] = s
+	default:
+		if old != nil {
+			old.cc.Close()
+		}
+		m.connSet[endpoint] = nil
 	}
-	m.connSet[endpoint] = cc
 
 	// 将所有endpoint整合到一起，按照名字排序
 	var idx = 0
 	for ; idx < len(m.endpoints); idx++ {
 		if m.endpoints[idx] == endpoint {
-			continue
+			break
 		}
 	}
 	if idx >= len(m.endpoints) {
@@ -56,50 +137,92 @@ func (m *clientConnManager) ResetConn(endpoint string, cc *grpc.ClientConn) {
 	sort.Strings(m.endpoints)
 }
 
-func (m *clientConnManager) GetConn(endpoint string) *grpc.ClientConn {
+// RemoveConn 关闭并移除endpoint对应的连接，同时将其从有序的endpoints列表中摘除
+func (m *clientConnManager) RemoveConn(endpoint string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if s, ok := m.connSet[endpoint]; ok {
+		if s != nil {
+			s.cc.Close()
+		}
+		delete(m.connSet, endpoint)
+	}
+
+	for idx, ep := range m.endpoints {
+		if ep == endpoint {
+			m.endpoints = append(m.endpoints[:idx], m.endpoints[idx+1:]...)
+			break
+		}
+	}
+}
+
+// SetAllDraining 将所有已建立的连接标记为draining(或取消标记)，draining的连接
+// 不再被FirstAvailableConn/RoundRobinConn选中，但不会被关闭
+func (m *clientConnManager) SetAllDraining(draining bool) {
+	var v int32
+	if draining {
+		v = 1
+	}
+	atomic.StoreInt32(&m.draining, v)
+
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
-	return m.connSet[endpoint]
+	for _, s := range m.connSet {
+		if s != nil {
+			s.setDraining(draining)
+		}
+	}
 }
 
-func (m *clientConnManager) FirstAvailableConn() (*grpc.ClientConn, error) {
+// InFlight 返回所有连接上的in-flight请求总数
+func (m *clientConnManager) InFlight() int64 {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
-	for _, endpoint := range m.endpoints {
-		if cc, _ := m.connSet[endpoint]; cc != nil {
-			return cc, nil
+	var total int64
+	for _, s := range m.connSet {
+		if s != nil {
+			total += s.InFlight()
 		}
 	}
-	return nil, errors.New("no available connection found")
+	return total
 }
 
-func (m *clientConnManager) RoundRobinConn() (*grpc.ClientConn, error) {
-	var firstEndpoint string
-	for {
-		cc, endpoint := m.roundRobin()
-		if endpoint == "" {
-			return nil, errors.New("no available connection found")
-		}
-		if cc != nil {
+func (m *clientConnManager) FirstAvailableConn() (grpc.ClientConnInterface, error) {
+	endpoints, conns := m.snapshot()
+	for _, endpoint := range endpoints {
+		if cc, ok := conns[endpoint]; ok {
 			return cc, nil
 		}
-		if firstEndpoint == "" {
-			firstEndpoint = endpoint
-			continue
-		}
-		if firstEndpoint == endpoint {
-			return nil, errors.New("no available connection found")
-		}
 	}
+	return nil, errors.New("no available connection found")
 }
 
-func (m *clientConnManager) roundRobin() (cc *grpc.ClientConn, endpoint string) {
+func (m *clientConnManager) RoundRobinConn() (grpc.ClientConnInterface, error) {
+	return m.PickWith(m.rrPicker)
+}
+
+// PickWith 使用给定的Picker从当前可用(非draining)的连接中选出一个，
+// 供HAClient.Pick()在用户配置了自定义选路策略时复用
+func (m *clientConnManager) PickWith(p Picker) (grpc.ClientConnInterface, error) {
+	endpoints, conns := m.snapshot()
+	return p.Pick(endpoints, conns)
+}
+
+// snapshot 返回一份有序的endpoints列表及其对应的、当前可用(非draining)连接的只读快照，
+// Picker据此做选路决策而不需要直接持有clientConnManager的锁
+func (m *clientConnManager) snapshot() ([]string, map[string]WeightedConn) {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
 
-	if len(m.endpoints) > 0 {
-		endpoint = m.endpoints[atomic.AddInt32(&m.lastRoundRobinIdx, 1)%int32(len(m.endpoints))]
-		return m.connSet[endpoint], endpoint
+	endpoints := make([]string, len(m.endpoints))
+	copy(endpoints, m.endpoints)
+
+	conns := make(map[string]WeightedConn, len(m.connSet))
+	for endpoint, s := range m.connSet {
+		if s != nil && !s.isDraining() {
+			conns[endpoint] = s
+		}
 	}
-	return nil, ""
+	return endpoints, conns
 }
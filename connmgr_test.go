@@ -1,6 +1,6 @@
 // +build unittest
 
-package gprc_haclient
+package grpc_haclient
 
 import (
 	"testing"
@@ -36,3 +36,32 @@ func TestClientConnManager(t *testing.T) {
 		}
 	}
 }
+
+func TestClientConnManagerResetConnInheritsDraining(t *testing.T) {
+	mgr := newClientConnManager()
+	mgr.ResetConn("0.0.0.1", &grpc.ClientConn{})
+	mgr.SetAllDraining(true)
+
+	// 模拟GracefulClose等待期间keepalive重新拨号/AddEndpoint新建立的连接，
+	// 它必须直接继承manager当前的draining状态，而不是以非draining状态重新对外提供服务
+	mgr.ResetConn("0.0.0.2", &grpc.ClientConn{})
+	if _, err := mgr.FirstAvailableConn(); err == nil {
+		t.Fatalf("expect no available connection while the manager is draining, even for a freshly reset one")
+	}
+
+	mgr.SetAllDraining(false)
+	if _, err := mgr.FirstAvailableConn(); err != nil {
+		t.Fatalf("expect an available connection once draining is cleared, got %v", err)
+	}
+}
+
+func TestClientConnManagerResetConnNoDuplicate(t *testing.T) {
+	mgr := newClientConnManager()
+	mgr.ResetConn("0.0.0.1", nil)
+	mgr.ResetConn("0.0.0.1", nil)
+	mgr.ResetConn("0.0.0.2", nil)
+
+	if n := len(mgr.endpoints); n != 2 {
+		t.Fatalf("expect 2 distinct endpoints, got %d: %v", n, mgr.endpoints)
+	}
+}
@@ -0,0 +1,160 @@
+// +build unittest
+
+package grpc_haclient
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+// rawCodec是一个直通[]byte的编解码器，仅用于在不依赖protobuf生成代码的情况下，
+// 手工搭建一个可以hold住的流式RPC，从而在测试里模拟一个耗时较长的in-flight调用
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	return v.([]byte), nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	*(v.(*[]byte)) = data
+	return nil
+}
+
+func (rawCodec) Name() string { return "raw" }
+
+func init() {
+	encoding.RegisterCodec(rawCodec{})
+}
+
+func TestHAClientGracefulClose(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed, %v", err)
+	}
+	defer lis.Close()
+
+	srv := grpc.NewServer()
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	c, err := newHAClient([]string{lis.Addr().String()}, func(cc *grpc.ClientConn) error { return nil })
+	if err != nil {
+		t.Fatalf("new haclient failed, %v", err)
+	}
+
+	if _, err := c.FirstAvailable(); err != nil {
+		t.Fatalf("expect an available connection before graceful close, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := c.GracefulClose(ctx); err != nil {
+		t.Fatalf("graceful close failed, %v", err)
+	}
+
+	if _, err := c.FirstAvailable(); err == nil {
+		t.Fatalf("expect no available connection after graceful close")
+	}
+}
+
+// TestHAClientGracefulCloseDrainsInFlightStream复现了review中指出的问题:
+// GracefulClose不能在仍有in-flight请求时就把底层连接关掉。测试手工搭建了一个
+// 会一直hold住的流式RPC(不依赖protobuf生成代码)，在调用完成前并发触发GracefulClose，
+// 断言这条in-flight调用能正常收到响应，而不是被提前关闭的连接abort掉
+func TestHAClientGracefulCloseDrainsInFlightStream(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed, %v", err)
+	}
+	defer lis.Close()
+
+	started := make(chan struct{})
+	hold := make(chan struct{})
+
+	srv := grpc.NewServer()
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "test.Echo",
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{
+			{
+				StreamName:    "Echo",
+				ServerStreams: true,
+				ClientStreams: true,
+				Handler: func(_ interface{}, stream grpc.ServerStream) error {
+					close(started)
+					var req []byte
+					if err := stream.RecvMsg(&req); err != nil {
+						return err
+					}
+					<-hold
+					return stream.SendMsg([]byte("ok"))
+				},
+			},
+		},
+	}, nil)
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	c, err := newHAClient([]string{lis.Addr().String()}, func(cc *grpc.ClientConn) error { return nil })
+	if err != nil {
+		t.Fatalf("new haclient failed, %v", err)
+	}
+
+	cc, err := c.FirstAvailable()
+	if err != nil {
+		t.Fatalf("expect an available connection, got %v", err)
+	}
+
+	stream, err := cc.NewStream(
+		context.Background(),
+		&grpc.StreamDesc{StreamName: "Echo", ServerStreams: true, ClientStreams: true},
+		"/test.Echo/Echo",
+		grpc.CallContentSubtype("raw"),
+	)
+	if err != nil {
+		t.Fatalf("new stream failed, %v", err)
+	}
+	if err := stream.SendMsg([]byte("ping")); err != nil {
+		t.Fatalf("send failed, %v", err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("close send failed, %v", err)
+	}
+	<-started
+
+	if c.availableConnManager.InFlight() == 0 {
+		t.Fatalf("expect in-flight count to be non-zero while the stream is still open")
+	}
+
+	closeDone := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		closeDone <- c.GracefulClose(ctx)
+	}()
+
+	// 给GracefulClose一点时间进入drain等待，确认它不会把这条还在处理中的连接提前关闭掉
+	time.Sleep(200 * time.Millisecond)
+	close(hold)
+
+	var resp []byte
+	if err := stream.RecvMsg(&resp); err != nil {
+		t.Fatalf("expect the in-flight call to complete successfully despite GracefulClose, got error: %v", err)
+	}
+	if string(resp) != "ok" {
+		t.Fatalf("unexpected response %q", resp)
+	}
+	// 再收一次触发io.EOF，让trackedStream把inflight计数减回去，GracefulClose才能感知到drain完成
+	if err := stream.RecvMsg(&resp); err == nil {
+		t.Fatalf("expect io.EOF once the server has finished the stream")
+	}
+
+	if err := <-closeDone; err != nil {
+		t.Fatalf("graceful close failed, %v", err)
+	}
+}
@@ -1,14 +1,25 @@
-package gprc_haclient
+package grpc_haclient
 
 import (
 	"context"
 	"errors"
 	"fmt"
+	"math/rand"
+	"net"
 	"strings"
 	"sync"
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	// redialBackoffBase 是重新拨号的退避基准时间
+	redialBackoffBase = 500 * time.Millisecond
+	// redialBackoffCap 是重新拨号的退避时间上限
+	redialBackoffCap = 30 * time.Second
 )
 
 // ReadinessProbeRPC 是对远程服务端获取readiness状态的rpc调用抽象
@@ -16,14 +27,28 @@ type ReadinessProbeRPC func(cc *grpc.ClientConn) error
 
 // HAClient 是对grpc连接的高可用的抽象
 type HAClient interface {
-	// Close 释放资源，必须被调用
+	// Close 立即关闭所有连接，必须被调用(除非调用了GracefulClose)，等价于grpc.Server的Stop
 	Close()
 
+	// GracefulClose 优雅关闭：先让之后的RoundRobin/FirstAvailable不再返回本client管理的连接，
+	// 再等待(不超过ctx)已有的in-flight请求完成后才真正关闭所有连接，等价于grpc.Server的GracefulStop
+	GracefulClose(ctx context.Context) error
+
 	// RoundRobin 轮询使用配置的连接
-	RoundRobin() (*grpc.ClientConn, error)
+	RoundRobin() (grpc.ClientConnInterface, error)
 
 	// FirstAvailable 获取当前第一个可用的连接
-	FirstAvailable() (*grpc.ClientConn, error)
+	FirstAvailable() (grpc.ClientConnInterface, error)
+
+	// Pick 使用WithPicker/WithEndpointWeights配置的选路策略选择一个连接，默认为RoundRobinPicker
+	Pick() (grpc.ClientConnInterface, error)
+
+	// AddEndpoint 新增一个endpoint并为其启动keepalive goroutine，已存在的endpoint会被忽略
+	AddEndpoint(endpoint string)
+
+	// RemoveEndpoint 移除一个endpoint，取消其keepalive goroutine并关闭对应的连接，
+	// 不存在的endpoint会被忽略
+	RemoveEndpoint(endpoint string)
 }
 
 func New(endpoints []string, readinessProbeRPC ReadinessProbeRPC, opts ...haClientOption) (HAClient, error) {
@@ -42,30 +67,63 @@ type haclient struct {
 	// dialTimeout 与远程建立TCP连接的超时时间
 	dialTimeout time.Duration
 
-	keepaliveWaitGroup   sync.WaitGroup
-	endpoints            []string
+	// resolver 用于获取endpoints快照，默认为静态endpoints列表，也可以是etcd等动态实现
+	resolver Resolver
+
+	// picker 是Pick()使用的选路策略，默认为RoundRobinPicker
+	picker Picker
+
+	// transportCreds 不为nil时，dial()使用它代替grpc.WithInsecure()
+	transportCreds credentials.TransportCredentials
+	// dialOptions 会被追加到dial()内部构造的grpc.DialOption列表末尾
+	dialOptions []grpc.DialOption
+	// unaryInterceptors/streamInterceptors 追加的客户端拦截器
+	unaryInterceptors  []grpc.UnaryClientInterceptor
+	streamInterceptors []grpc.StreamClientInterceptor
+
+	keepaliveWaitGroup sync.WaitGroup
+	endpoints          []string
+
+	// endpointMutex 保护 endpointCancels 的并发访问
+	endpointMutex sync.Mutex
+	// endpointCancels 记录每个endpoint对应的keepalive goroutine的取消函数
+	endpointCancels map[string]context.CancelFunc
+
 	availableConnManager *clientConnManager
 }
 
 func newHAClient(endpoints []string, readinessProbeRPC ReadinessProbeRPC, opts ...haClientOption) (*haclient, error) {
-	if len(endpoints) == 0 {
-		return nil, errors.New("no endpoints found")
-	}
-	if readinessProbeRPC == nil {
-		return nil, errors.New("readinessProbeRPC cannot be nil")
-	}
-
 	c := &haclient{}
 	c.ctx, c.cancel = context.WithCancel(context.Background())
-	c.endpoints = endpoints
 	c.readinessProbeRPC = readinessProbeRPC
 	c.availableConnManager = newClientConnManager()
 	c.dialTimeout = 5 * time.Second
+	c.picker = NewRoundRobinPicker()
+	c.endpointCancels = make(map[string]context.CancelFunc)
 	for _, opt := range opts {
 		opt(c)
 	}
 
-	go c.keepalive()
+	if c.resolver == nil {
+		if len(endpoints) == 0 {
+			return nil, errors.New("no endpoints found")
+		}
+		c.resolver = NewStaticResolver(endpoints)
+	}
+
+	endpointsCh, err := c.resolver.Resolve(c.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("resolve endpoints failed, %v", err)
+	}
+
+	// 应用首份快照，保证返回前至少已经开始对这些endpoints做keepalive
+	select {
+	case snapshot := <-endpointsCh:
+		c.applyEndpoints(snapshot)
+	case <-c.ctx.Done():
+		return nil, errors.New("haclient closed before endpoints resolved")
+	}
+	go c.watchResolver(endpointsCh)
 
 	for i := 0; i < 30; i++ {
 		time.Sleep(2 * time.Second)
@@ -77,70 +135,267 @@ func newHAClient(endpoints []string, readinessProbeRPC ReadinessProbeRPC, opts .
 	return nil, fmt.Errorf("no available endpoints %s", strings.Join(endpoints, ","))
 }
 
-// keepalive 与 endpoints 保持联系
-func (c *haclient) keepalive() {
-	c.keepaliveWaitGroup.Add(len(c.endpoints))
-
-	for _, endpoint := range c.endpoints {
-		// do health check
-		go func(endpoint string) {
-			defer c.keepaliveWaitGroup.Done()
-
-			var err error
-			var ticker = time.NewTicker(1 * time.Second)
-			defer ticker.Stop()
-
-			for {
-				select {
-				case <-c.ctx.Done():
-					return
-				case <-ticker.C:
-					cc := c.availableConnManager.GetConn(endpoint)
-					// 连接存在，进行readiness probe
-					if cc != nil {
-						if err = c.readinessProbeRPC(cc); err != nil {
-							fmt.Printf("%s endpoint `%s` is unhealthy now", c.logPrefix(), endpoint)
-							c.availableConnManager.ResetConn(endpoint, nil)
-						}
-						continue
-					}
-					// 连接不存在，新建连接
-					if cc, err = c.dial(endpoint); err != nil {
-						fmt.Printf("%s endpoint `%s` is bad, dial failed, %v", c.logPrefix(), endpoint, err)
-						continue
-					}
-					if err = c.readinessProbeRPC(cc); err != nil {
-						fmt.Printf("%s endpoint `%s` is unhealthy now", c.logPrefix(), endpoint)
-						cc.Close()
-						continue
-					}
-					c.availableConnManager.ResetConn(endpoint, cc)
+// watchResolver 持续消费resolver推送的endpoints快照，并据此增量调整keepalive goroutine
+func (c *haclient) watchResolver(ch <-chan []string) {
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case snapshot, ok := <-ch:
+			if !ok {
+				return
+			}
+			c.applyEndpoints(snapshot)
+		}
+	}
+}
+
+// applyEndpoints 将当前endpoints集合调整为snapshot: 为新增的endpoint启动keepalive goroutine，
+// 为被移除的endpoint取消其keepalive goroutine并关闭连接
+func (c *haclient) applyEndpoints(snapshot []string) {
+	c.endpointMutex.Lock()
+	defer c.endpointMutex.Unlock()
+
+	newSet := make(map[string]struct{}, len(snapshot))
+	for _, endpoint := range snapshot {
+		newSet[endpoint] = struct{}{}
+		if _, ok := c.endpointCancels[endpoint]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(c.ctx)
+		c.endpointCancels[endpoint] = cancel
+		c.keepaliveWaitGroup.Add(1)
+		go c.keepaliveOne(ctx, endpoint)
+	}
+
+	for endpoint, cancel := range c.endpointCancels {
+		if _, ok := newSet[endpoint]; ok {
+			continue
+		}
+		cancel()
+		delete(c.endpointCancels, endpoint)
+		c.availableConnManager.RemoveConn(endpoint)
+	}
+
+	c.endpoints = snapshot
+}
+
+// keepaliveOne 与单个endpoint保持联系，直到ctx被取消。
+// 它以grpc自身的connectivity.State变迁作为存活判断的主信号：conn进入Ready即视为可用，
+// 进入TransientFailure/Shutdown则摘除并按指数退避重新拨号，readinessProbeRPC仅作为Ready之后的二次校验。
+func (c *haclient) keepaliveOne(ctx context.Context, endpoint string) {
+	defer c.keepaliveWaitGroup.Done()
+
+	backoff := redialBackoffBase
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		cc, err := c.dial(endpoint)
+		if err != nil {
+			fmt.Printf("%s endpoint `%s` is bad, dial failed, %v", c.logPrefix(), endpoint, err)
+			if !c.sleepBackoff(ctx, &backoff) {
+				return
+			}
+			continue
+		}
+
+		ctxAlive := c.watchConn(ctx, endpoint, cc, &backoff)
+		if !ctxAlive {
+			// ctx被取消，通常意味着RemoveEndpoint/applyEndpoints已经(或正在)调用
+			// RemoveConn摘除这个endpoint了，这里不再调用ResetConn，否则会把它重新
+			// 插回connSet/endpoints，变成一个永远不会被再次清理的僵尸endpoint
+			cc.Close()
+			return
+		}
+		c.availableConnManager.ResetConn(endpoint, nil)
+		cc.Close()
+		if !c.sleepBackoff(ctx, &backoff) {
+			return
+		}
+	}
+}
+
+// watchConn 订阅cc的connectivity.State变化并据此更新availableConnManager，
+// 返回false表示ctx已被取消，调用方应立即退出；返回true表示conn已失效，需要重新拨号
+func (c *haclient) watchConn(ctx context.Context, endpoint string, cc *grpc.ClientConn, backoff *time.Duration) bool {
+	state := cc.GetState()
+	for {
+		switch state {
+		case connectivity.Ready:
+			if c.readinessProbeRPC != nil {
+				if err := c.readinessProbeRPC(cc); err != nil {
+					fmt.Printf("%s endpoint `%s` is unhealthy now, %v", c.logPrefix(), endpoint, err)
+					c.availableConnManager.ResetConn(endpoint, nil)
+					return true
 				}
 			}
-		}(endpoint)
+			c.availableConnManager.ResetConn(endpoint, cc)
+			*backoff = redialBackoffBase
+		case connectivity.TransientFailure, connectivity.Shutdown:
+			fmt.Printf("%s endpoint `%s` is unhealthy now, state=%s", c.logPrefix(), endpoint, state)
+			c.availableConnManager.ResetConn(endpoint, nil)
+			return true
+		}
+
+		if !cc.WaitForStateChange(ctx, state) {
+			return false
+		}
+		state = cc.GetState()
 	}
 }
 
+// sleepBackoff 按当前退避时间(附带抖动)休眠，并将*backoff推进到下一级，封顶redialBackoffCap
+func (c *haclient) sleepBackoff(ctx context.Context, backoff *time.Duration) bool {
+	jitter := time.Duration(rand.Int63n(int64(*backoff)/2 + 1))
+	wait := *backoff/2 + jitter
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(wait):
+	}
+
+	*backoff *= 2
+	if *backoff > redialBackoffCap {
+		*backoff = redialBackoffCap
+	}
+	return true
+}
+
 func (c *haclient) dial(endpoint string) (*grpc.ClientConn, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), c.dialTimeout)
 	defer cancel()
-	return grpc.DialContext(ctx, endpoint, grpc.WithInsecure())
+
+	opts := make([]grpc.DialOption, 0, len(c.dialOptions)+3)
+	if c.transportCreds != nil {
+		opts = append(opts, grpc.WithTransportCredentials(c.transportCreds))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	if len(c.unaryInterceptors) > 0 {
+		opts = append(opts, grpc.WithChainUnaryInterceptor(c.unaryInterceptors...))
+	}
+	if len(c.streamInterceptors) > 0 {
+		opts = append(opts, grpc.WithChainStreamInterceptor(c.streamInterceptors...))
+	}
+	opts = append(opts, c.dialOptions...)
+
+	// unix://path 形式的endpoint通过unix domain socket拨号，参考了etcd clientv3的Dial实现
+	if strings.HasPrefix(endpoint, "unix://") {
+		sockPath := strings.TrimPrefix(endpoint, "unix://")
+		opts = append(opts, grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sockPath)
+		}))
+	}
+
+	return grpc.DialContext(ctx, endpoint, opts...)
 }
 
+// drainPollInterval 是GracefulClose轮询in-flight请求数的周期
+const drainPollInterval = 100 * time.Millisecond
+
 func (c *haclient) Close() {
 	c.once.Do(func() {
+		c.cancel()
+		// 等待所有keepalive goroutine退出: 它们各自负责关闭自己当前持有的连接，
+		// 如果这里不等待就直接CloseAll，一个恰好在dial/watchConn中途的goroutine
+		// 可能在CloseAll之后才把新连接注册/关闭，导致Close()返回时连接并未真正清理干净
+		c.keepaliveWaitGroup.Wait()
 		c.availableConnManager.CloseAll()
 	})
 }
 
-func (c *haclient) FirstAvailable() (*grpc.ClientConn, error) {
+func (c *haclient) GracefulClose(ctx context.Context) error {
+	var err error
+	c.once.Do(func() {
+		// 标记所有连接为draining，新的RoundRobin/FirstAvailable/Pick调用不会再拿到它们。
+		// 注意这里先不cancel c.ctx：keepaliveOne在ctx被取消后会无条件关闭它持有的*grpc.ClientConn，
+		// 如果此刻就cancel，会把仍有in-flight请求的连接提前关闭掉，等于没有draining
+		c.availableConnManager.SetAllDraining(true)
+
+		ticker := time.NewTicker(drainPollInterval)
+		defer ticker.Stop()
+
+	drain:
+		for {
+			if c.availableConnManager.InFlight() == 0 {
+				break drain
+			}
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+				break drain
+			case <-ticker.C:
+				// keepalive goroutine在draining期间仍可能重新拨号出新的连接，持续补标draining
+				c.availableConnManager.SetAllDraining(true)
+			}
+		}
+
+		// in-flight请求已经清空(或等待超时)，现在才让keepalive goroutine退出并关闭所有连接
+		c.cancel()
+		c.keepaliveWaitGroup.Wait()
+		c.availableConnManager.CloseAll()
+	})
+	return err
+}
+
+func (c *haclient) FirstAvailable() (grpc.ClientConnInterface, error) {
 	return c.availableConnManager.FirstAvailableConn()
 }
 
-func (c *haclient) RoundRobin() (*grpc.ClientConn, error) {
+func (c *haclient) RoundRobin() (grpc.ClientConnInterface, error) {
 	return c.availableConnManager.RoundRobinConn()
 }
 
+func (c *haclient) Pick() (grpc.ClientConnInterface, error) {
+	return c.availableConnManager.PickWith(c.picker)
+}
+
+// AddEndpoint 新增一个endpoint并为其启动keepalive goroutine，已存在的endpoint会被忽略。
+// 这与applyEndpoints共用endpointCancels，既可作为独立API使用，也是resolver驱动的
+// 成员变更所依赖的基础能力
+func (c *haclient) AddEndpoint(endpoint string) {
+	c.endpointMutex.Lock()
+	defer c.endpointMutex.Unlock()
+
+	if _, ok := c.endpointCancels[endpoint]; ok {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.endpointCancels[endpoint] = cancel
+	c.keepaliveWaitGroup.Add(1)
+	go c.keepaliveOne(ctx, endpoint)
+
+	c.endpoints = append(c.endpoints, endpoint)
+}
+
+// RemoveEndpoint 移除一个endpoint，取消其keepalive goroutine并关闭对应的连接，
+// 不存在的endpoint会被忽略
+func (c *haclient) RemoveEndpoint(endpoint string) {
+	c.endpointMutex.Lock()
+	defer c.endpointMutex.Unlock()
+
+	cancel, ok := c.endpointCancels[endpoint]
+	if !ok {
+		return
+	}
+	cancel()
+	delete(c.endpointCancels, endpoint)
+	c.availableConnManager.RemoveConn(endpoint)
+
+	for i, ep := range c.endpoints {
+		if ep == endpoint {
+			c.endpoints = append(c.endpoints[:i], c.endpoints[i+1:]...)
+			break
+		}
+	}
+}
+
 func (c *haclient) logPrefix() string {
 	return "grpc-haclient:"
 }
@@ -154,3 +409,63 @@ func WithDialTimeout(timeout time.Duration) haClientOption {
 		c.dialTimeout = timeout
 	}
 }
+
+// WithResolver 设置endpoints的解析器，用于替代New()传入的静态endpoints列表，
+// 从而支持基于服务发现(如etcd)的动态成员变更
+func WithResolver(r Resolver) haClientOption {
+	return func(c *haclient) {
+		c.resolver = r
+	}
+}
+
+// WithReadinessProbe 设置一个可选的readiness探测rpc，它只在conn达到connectivity.Ready之后
+// 作为二次校验门槛使用，不再是判断endpoint存活的主信号(主信号是grpc自身的connectivity.State)
+func WithReadinessProbe(rpc ReadinessProbeRPC) haClientOption {
+	return func(c *haclient) {
+		c.readinessProbeRPC = rpc
+	}
+}
+
+// WithPicker 设置Pick()使用的选路策略，默认为RoundRobinPicker
+func WithPicker(p Picker) haClientOption {
+	return func(c *haclient) {
+		c.picker = p
+	}
+}
+
+// WithEndpointWeights 使用WeightedRoundRobinPicker作为Pick()的选路策略，按照weights中
+// 配置的权重对endpoints做平滑加权轮询，未在weights中出现的endpoint权重按1处理
+func WithEndpointWeights(weights map[string]int) haClientOption {
+	return func(c *haclient) {
+		c.picker = NewWeightedRoundRobinPicker(weights)
+	}
+}
+
+// WithTransportCredentials 设置grpc连接使用的传输层安全凭证，用于连接TLS加密的服务端。
+// 不设置时dial()默认使用 grpc.WithInsecure()
+func WithTransportCredentials(creds credentials.TransportCredentials) haClientOption {
+	return func(c *haclient) {
+		c.transportCreds = creds
+	}
+}
+
+// WithDialOptions 追加额外的grpc.DialOption，会被合并到dial()内部构造的选项列表中
+func WithDialOptions(opts ...grpc.DialOption) haClientOption {
+	return func(c *haclient) {
+		c.dialOptions = append(c.dialOptions, opts...)
+	}
+}
+
+// WithUnaryInterceptor 追加grpc unary调用使用的客户端拦截器
+func WithUnaryInterceptor(interceptors ...grpc.UnaryClientInterceptor) haClientOption {
+	return func(c *haclient) {
+		c.unaryInterceptors = append(c.unaryInterceptors, interceptors...)
+	}
+}
+
+// WithStreamInterceptor 追加grpc stream调用使用的客户端拦截器
+func WithStreamInterceptor(interceptors ...grpc.StreamClientInterceptor) haClientOption {
+	return func(c *haclient) {
+		c.streamInterceptors = append(c.streamInterceptors, interceptors...)
+	}
+}
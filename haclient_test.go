@@ -0,0 +1,242 @@
+// +build unittest
+
+package grpc_haclient
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+func TestSleepBackoff(t *testing.T) {
+	c := &haclient{}
+	backoff := 10 * time.Millisecond
+
+	for i := 0; i < 5; i++ {
+		prev := backoff
+		if !c.sleepBackoff(context.Background(), &backoff) {
+			t.Fatalf("sleepBackoff must not fail on a live context")
+		}
+		if backoff != prev*2 && backoff != redialBackoffCap {
+			t.Fatalf("expect backoff to double or cap, got prev=%v new=%v", prev, backoff)
+		}
+	}
+}
+
+func TestSleepBackoffCancel(t *testing.T) {
+	c := &haclient{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	backoff := time.Second
+	if c.sleepBackoff(ctx, &backoff) {
+		t.Fatalf("sleepBackoff must return false once ctx is canceled")
+	}
+}
+
+func TestHAClientAddRemoveEndpoint(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed, %v", err)
+	}
+	defer lis.Close()
+
+	srv := grpc.NewServer()
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	c, err := newHAClient([]string{lis.Addr().String()}, func(cc *grpc.ClientConn) error { return nil })
+	if err != nil {
+		t.Fatalf("new haclient failed, %v", err)
+	}
+	defer c.Close()
+
+	lis2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed, %v", err)
+	}
+	defer lis2.Close()
+	srv2 := grpc.NewServer()
+	go srv2.Serve(lis2)
+	defer srv2.Stop()
+
+	c.AddEndpoint(lis2.Addr().String())
+	// 重复添加不应重复启动keepalive goroutine
+	c.AddEndpoint(lis2.Addr().String())
+
+	var available bool
+	for i := 0; i < 30; i++ {
+		time.Sleep(100 * time.Millisecond)
+		_, conns := c.availableConnManager.snapshot()
+		if _, ok := conns[lis2.Addr().String()]; ok {
+			available = true
+			break
+		}
+	}
+	if !available {
+		t.Fatalf("expect the newly added endpoint to become available")
+	}
+
+	c.RemoveEndpoint(lis2.Addr().String())
+	c.endpointMutex.Lock()
+	_, stillTracked := c.endpointCancels[lis2.Addr().String()]
+	c.endpointMutex.Unlock()
+	if stillTracked {
+		t.Fatalf("expect the endpoint's keepalive goroutine bookkeeping to be removed")
+	}
+
+	// keepaliveOne的goroutine此时通常还没从watchConn的WaitForStateChange中醒来，
+	// 等它醒来后不应该把这个endpoint重新插回connSet/endpoints，变成一个永远清理不掉的僵尸条目
+	for i := 0; i < 10; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.availableConnManager.mutex.RLock()
+	_, zombieConn := c.availableConnManager.connSet[lis2.Addr().String()]
+	zombieEndpoints := false
+	for _, ep := range c.availableConnManager.endpoints {
+		if ep == lis2.Addr().String() {
+			zombieEndpoints = true
+		}
+	}
+	c.availableConnManager.mutex.RUnlock()
+	if zombieConn || zombieEndpoints {
+		t.Fatalf("expect the removed endpoint to stay gone from connSet/endpoints, got connSet=%v endpoints=%v", zombieConn, zombieEndpoints)
+	}
+}
+
+func TestHAClientCloseWaitsForKeepaliveGoroutines(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed, %v", err)
+	}
+	defer lis.Close()
+
+	srv := grpc.NewServer()
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	c, err := newHAClient([]string{lis.Addr().String()}, func(cc *grpc.ClientConn) error { return nil })
+	if err != nil {
+		t.Fatalf("new haclient failed, %v", err)
+	}
+
+	// 模拟一个仍卡在dial/watchConn中途、尚未注意到ctx被取消的keepalive goroutine
+	release := make(chan struct{})
+	c.keepaliveWaitGroup.Add(1)
+	go func() {
+		<-release
+		c.keepaliveWaitGroup.Done()
+	}()
+
+	closeDone := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closeDone)
+	}()
+
+	select {
+	case <-closeDone:
+		t.Fatalf("expect Close to block until all keepalive goroutines have exited")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-closeDone:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expect Close to return once the remaining keepalive goroutine exits")
+	}
+}
+
+// channelResolver是一个测试用的Resolver，把调用方写入的endpoints快照原样转发出去，
+// 用于模拟etcd等真实resolver持续推送成员变更的场景
+type channelResolver struct {
+	snapshots chan []string
+}
+
+func (r *channelResolver) Resolve(ctx context.Context) (<-chan []string, error) {
+	out := make(chan []string, 1)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case snapshot, ok := <-r.snapshots:
+				if !ok {
+					return
+				}
+				select {
+				case out <- snapshot:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+func TestHAClientResolverDrivenRemovalNoZombie(t *testing.T) {
+	lis1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed, %v", err)
+	}
+	defer lis1.Close()
+	srv1 := grpc.NewServer()
+	go srv1.Serve(lis1)
+	defer srv1.Stop()
+
+	lis2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed, %v", err)
+	}
+	defer lis2.Close()
+	srv2 := grpc.NewServer()
+	go srv2.Serve(lis2)
+	defer srv2.Stop()
+
+	resolver := &channelResolver{snapshots: make(chan []string, 1)}
+	resolver.snapshots <- []string{lis1.Addr().String(), lis2.Addr().String()}
+
+	c, err := newHAClient(nil, func(cc *grpc.ClientConn) error { return nil }, WithResolver(resolver))
+	if err != nil {
+		t.Fatalf("new haclient failed, %v", err)
+	}
+	defer c.Close()
+
+	var bothAvailable bool
+	for i := 0; i < 30; i++ {
+		time.Sleep(100 * time.Millisecond)
+		_, conns := c.availableConnManager.snapshot()
+		if _, ok := conns[lis2.Addr().String()]; ok {
+			bothAvailable = true
+			break
+		}
+	}
+	if !bothAvailable {
+		t.Fatalf("expect lis2 to become available before it's dropped by the resolver")
+	}
+
+	// resolver推送一份不再包含lis2的快照，模拟服务发现中该实例被下线
+	resolver.snapshots <- []string{lis1.Addr().String()}
+
+	for i := 0; i < 10; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.availableConnManager.mutex.RLock()
+	_, zombieConn := c.availableConnManager.connSet[lis2.Addr().String()]
+	zombieEndpoints := false
+	for _, ep := range c.availableConnManager.endpoints {
+		if ep == lis2.Addr().String() {
+			zombieEndpoints = true
+		}
+	}
+	c.availableConnManager.mutex.RUnlock()
+	if zombieConn || zombieEndpoints {
+		t.Fatalf("expect the resolver-removed endpoint to stay gone from connSet/endpoints, got connSet=%v endpoints=%v", zombieConn, zombieEndpoints)
+	}
+}
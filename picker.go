@@ -0,0 +1,159 @@
+package grpc_haclient
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+)
+
+var errNoAvailableConn = errors.New("no available connection found")
+
+// WeightedConn 在grpc.ClientConnInterface之上额外暴露了Picker做选路决策所需要的信息
+type WeightedConn interface {
+	grpc.ClientConnInterface
+
+	// InFlight 返回该连接上当前的in-flight请求数
+	InFlight() int64
+}
+
+// Picker 是连接选路策略的抽象，类似于grpc内部balancer的picker概念。
+// endpoints已按照clientConnManager内部的顺序排好序，conns只包含当前可用(非draining)的连接，
+// 二者配合使Picker实现可以脱离真实grpc连接、仅用假数据做单元测试
+type Picker interface {
+	Pick(endpoints []string, conns map[string]WeightedConn) (grpc.ClientConnInterface, error)
+}
+
+// RoundRobinPicker 按照endpoints的顺序轮询选择一个可用连接
+type RoundRobinPicker struct {
+	lastIdx int32 // 记录上一次选中的位置，从clientConnManager挪过来的
+}
+
+// NewRoundRobinPicker 创建一个RoundRobinPicker
+func NewRoundRobinPicker() *RoundRobinPicker {
+	return &RoundRobinPicker{lastIdx: -1}
+}
+
+func (p *RoundRobinPicker) Pick(endpoints []string, conns map[string]WeightedConn) (grpc.ClientConnInterface, error) {
+	if len(endpoints) == 0 {
+		return nil, errNoAvailableConn
+	}
+	for i := 0; i < len(endpoints); i++ {
+		idx := atomic.AddInt32(&p.lastIdx, 1) % int32(len(endpoints))
+		if cc, ok := conns[endpoints[idx]]; ok {
+			return cc, nil
+		}
+	}
+	return nil, errNoAvailableConn
+}
+
+// WeightedRoundRobinPicker 按照每个endpoint配置的权重做平滑加权轮询(参考nginx smooth weighted round-robin)，
+// 权重越高的endpoint在一轮内被选中的次数越多
+type WeightedRoundRobinPicker struct {
+	weights map[string]int
+
+	mutex  sync.Mutex
+	cursor map[string]int // 每个endpoint当前的权重游标
+}
+
+// NewWeightedRoundRobinPicker 创建一个WeightedRoundRobinPicker，weights中未配置的endpoint权重按1处理
+func NewWeightedRoundRobinPicker(weights map[string]int) *WeightedRoundRobinPicker {
+	return &WeightedRoundRobinPicker{
+		weights: weights,
+		cursor:  make(map[string]int),
+	}
+}
+
+func (p *WeightedRoundRobinPicker) Pick(endpoints []string, conns map[string]WeightedConn) (grpc.ClientConnInterface, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var best string
+	var bestCursor = -1
+	var total int
+	for _, endpoint := range endpoints {
+		if _, ok := conns[endpoint]; !ok {
+			continue
+		}
+		weight := p.weights[endpoint]
+		if weight <= 0 {
+			weight = 1
+		}
+		total += weight
+		p.cursor[endpoint] += weight
+		if p.cursor[endpoint] > bestCursor {
+			bestCursor = p.cursor[endpoint]
+			best = endpoint
+		}
+	}
+	if best == "" {
+		return nil, errNoAvailableConn
+	}
+	p.cursor[best] -= total
+	return conns[best], nil
+}
+
+// LeastInFlightPicker 选择当前in-flight请求数最少的连接
+type LeastInFlightPicker struct{}
+
+// NewLeastInFlightPicker 创建一个LeastInFlightPicker
+func NewLeastInFlightPicker() *LeastInFlightPicker {
+	return &LeastInFlightPicker{}
+}
+
+func (p *LeastInFlightPicker) Pick(endpoints []string, conns map[string]WeightedConn) (grpc.ClientConnInterface, error) {
+	var best WeightedConn
+	var bestLoad int64 = -1
+	for _, endpoint := range endpoints {
+		cc, ok := conns[endpoint]
+		if !ok {
+			continue
+		}
+		if load := cc.InFlight(); bestLoad < 0 || load < bestLoad {
+			bestLoad = load
+			best = cc
+		}
+	}
+	if best == nil {
+		return nil, errNoAvailableConn
+	}
+	return best, nil
+}
+
+// RandomTwoChoicesPicker 随机挑选两个候选连接，选择其中in-flight请求数更少的那个(power-of-two-choices)，
+// 比纯随机更能避免负载倾斜，又比遍历全部连接的LeastInFlightPicker开销更低
+type RandomTwoChoicesPicker struct{}
+
+// NewRandomTwoChoicesPicker 创建一个RandomTwoChoicesPicker
+func NewRandomTwoChoicesPicker() *RandomTwoChoicesPicker {
+	return &RandomTwoChoicesPicker{}
+}
+
+func (p *RandomTwoChoicesPicker) Pick(endpoints []string, conns map[string]WeightedConn) (grpc.ClientConnInterface, error) {
+	candidates := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		if _, ok := conns[endpoint]; ok {
+			candidates = append(candidates, endpoint)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, errNoAvailableConn
+	}
+	if len(candidates) == 1 {
+		return conns[candidates[0]], nil
+	}
+
+	i := rand.Intn(len(candidates))
+	j := rand.Intn(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+
+	a, b := conns[candidates[i]], conns[candidates[j]]
+	if a.InFlight() <= b.InFlight() {
+		return a, nil
+	}
+	return b, nil
+}
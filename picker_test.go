@@ -0,0 +1,111 @@
+// +build unittest
+
+package grpc_haclient
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc"
+)
+
+// fakeConn 是一个不依赖真实grpc连接的WeightedConn实现，专门用于Picker单元测试
+type fakeConn struct {
+	inflight int64
+}
+
+func (f *fakeConn) Invoke(ctx context.Context, method string, args, reply interface{}, opts ...grpc.CallOption) error {
+	return nil
+}
+
+func (f *fakeConn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return nil, nil
+}
+
+func (f *fakeConn) InFlight() int64 {
+	return f.inflight
+}
+
+func TestRoundRobinPicker(t *testing.T) {
+	endpoints := []string{"a", "b", "c"}
+	conns := map[string]WeightedConn{
+		"a": &fakeConn{},
+		"b": &fakeConn{},
+		"c": &fakeConn{},
+	}
+
+	p := NewRoundRobinPicker()
+	seen := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		cc, err := p.Pick(endpoints, conns)
+		if err != nil {
+			t.Fatalf("pick failed, %v", err)
+		}
+		for ep, c := range conns {
+			if c == cc {
+				seen[ep]++
+			}
+		}
+	}
+	for _, ep := range endpoints {
+		if seen[ep] != 2 {
+			t.Fatalf("expect endpoint %s to be picked twice, got %d", ep, seen[ep])
+		}
+	}
+}
+
+func TestRoundRobinPickerNoConns(t *testing.T) {
+	p := NewRoundRobinPicker()
+	if _, err := p.Pick(nil, nil); err == nil {
+		t.Fatalf("expect error when no endpoints are available")
+	}
+}
+
+func TestWeightedRoundRobinPicker(t *testing.T) {
+	endpoints := []string{"a", "b"}
+	a, b := &fakeConn{}, &fakeConn{}
+	conns := map[string]WeightedConn{"a": a, "b": b}
+
+	p := NewWeightedRoundRobinPicker(map[string]int{"a": 3, "b": 1})
+	counts := map[grpc.ClientConnInterface]int{}
+	for i := 0; i < 4; i++ {
+		cc, err := p.Pick(endpoints, conns)
+		if err != nil {
+			t.Fatalf("pick failed, %v", err)
+		}
+		counts[cc]++
+	}
+	if counts[a] != 3 || counts[b] != 1 {
+		t.Fatalf("expect 3:1 weighted distribution, got a=%d b=%d", counts[a], counts[b])
+	}
+}
+
+func TestLeastInFlightPicker(t *testing.T) {
+	endpoints := []string{"a", "b"}
+	busy := &fakeConn{inflight: 5}
+	idle := &fakeConn{inflight: 0}
+	conns := map[string]WeightedConn{"a": busy, "b": idle}
+
+	p := NewLeastInFlightPicker()
+	cc, err := p.Pick(endpoints, conns)
+	if err != nil {
+		t.Fatalf("pick failed, %v", err)
+	}
+	if cc != idle {
+		t.Fatalf("expect the idle connection to be picked")
+	}
+}
+
+func TestRandomTwoChoicesPickerSingleCandidate(t *testing.T) {
+	endpoints := []string{"a"}
+	conns := map[string]WeightedConn{"a": &fakeConn{}}
+
+	p := NewRandomTwoChoicesPicker()
+	cc, err := p.Pick(endpoints, conns)
+	if err != nil {
+		t.Fatalf("pick failed, %v", err)
+	}
+	if cc != conns["a"] {
+		t.Fatalf("expect the only candidate to be picked")
+	}
+}
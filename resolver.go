@@ -0,0 +1,36 @@
+package grpc_haclient
+
+import (
+	"context"
+)
+
+// Resolver 是endpoint解析器的抽象，参考了grpc自身的resolver.Builder/resolver.Resolver模式。
+// 与grpc内置的resolver不同的是，这里以一个只读channel的形式持续地推送最新的endpoints快照，
+// 而不是通过ClientConn回调，这样可以更方便地接入haclient已有的keepalive机制。
+type Resolver interface {
+	// Resolve 启动解析过程，返回一个会持续收到最新endpoints快照的channel。
+	// 首次调用应立即(或尽快)推送一份初始快照。当ctx被取消时，Resolver必须停止后台工作并关闭返回的channel。
+	Resolve(ctx context.Context) (<-chan []string, error)
+}
+
+// staticResolver 是endpoints为固定列表时的Resolver实现，用于保持引入Resolver之前的行为
+type staticResolver struct {
+	endpoints []string
+}
+
+// NewStaticResolver 创建一个只推送一次固定endpoints快照的Resolver
+func NewStaticResolver(endpoints []string) Resolver {
+	return &staticResolver{endpoints: endpoints}
+}
+
+func (r *staticResolver) Resolve(ctx context.Context) (<-chan []string, error) {
+	ch := make(chan []string, 1)
+	ch <- r.endpoints
+
+	go func() {
+		<-ctx.Done()
+		close(ch)
+	}()
+
+	return ch, nil
+}
@@ -0,0 +1,76 @@
+package grpc_haclient
+
+import (
+	"context"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// EtcdResolver 通过watch etcd中某个key前缀下的节点变化，动态地推送endpoints快照，
+// 每个key对应的value即为一个endpoint地址(形如 "ip:port")
+type EtcdResolver struct {
+	client *clientv3.Client
+	prefix string
+}
+
+// NewEtcdResolver 创建一个基于etcd v3 watch的Resolver，prefix为待监听的key前缀
+func NewEtcdResolver(client *clientv3.Client, prefix string) *EtcdResolver {
+	return &EtcdResolver{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+func (r *EtcdResolver) Resolve(ctx context.Context) (<-chan []string, error) {
+	snapshot, err := r.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan []string, 1)
+	ch <- snapshot
+
+	go r.watch(ctx, ch)
+	return ch, nil
+}
+
+// list 全量拉取prefix下的endpoints
+func (r *EtcdResolver) list(ctx context.Context) ([]string, error) {
+	resp, err := r.client.Get(ctx, r.prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := make([]string, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		endpoints = append(endpoints, string(kv.Value))
+	}
+	return endpoints, nil
+}
+
+// watch 持续监听prefix下的变化，每次变化都重新拉取全量endpoints并推送
+func (r *EtcdResolver) watch(ctx context.Context, ch chan<- []string) {
+	defer close(ch)
+
+	watchCh := r.client.Watch(ctx, r.prefix, clientv3.WithPrefix())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-watchCh:
+			if !ok {
+				return
+			}
+			endpoints, err := r.list(ctx)
+			if err != nil {
+				// 拉取失败时保留上一份快照，等待下一次变化事件重试
+				continue
+			}
+			select {
+			case ch <- endpoints:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
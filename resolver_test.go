@@ -0,0 +1,28 @@
+// +build unittest
+
+package grpc_haclient
+
+import (
+	"context"
+	"testing"
+)
+
+func TestStaticResolver(t *testing.T) {
+	r := NewStaticResolver([]string{"0.0.0.1", "0.0.0.2"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := r.Resolve(ctx)
+	if err != nil {
+		t.Fatalf("resolve failed, %v", err)
+	}
+
+	snapshot := <-ch
+	if len(snapshot) != 2 {
+		t.Fatalf("expect 2 endpoints, got %d", len(snapshot))
+	}
+
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Fatalf("channel must be closed after ctx canceled")
+	}
+}
@@ -0,0 +1,82 @@
+// +build unittest
+
+package grpc_haclient
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// selfSignedCert 生成一张仅用于单元测试的自签名证书，CN/SAN均为127.0.0.1
+func selfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key failed, %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate failed, %v", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("build tls certificate failed, %v", err)
+	}
+	return cert
+}
+
+func TestHAClientWithTransportCredentials(t *testing.T) {
+	cert := selfSignedCert(t)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed, %v", err)
+	}
+	defer lis.Close()
+
+	srv := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{cert}})))
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	clientTLSConf := &tls.Config{InsecureSkipVerify: true}
+	c, err := newHAClient(
+		[]string{lis.Addr().String()},
+		func(cc *grpc.ClientConn) error { return nil },
+		WithTransportCredentials(credentials.NewTLS(clientTLSConf)),
+	)
+	if err != nil {
+		t.Fatalf("new haclient over tls failed, %v", err)
+	}
+	defer c.Close()
+
+	if _, err := c.FirstAvailable(); err != nil {
+		t.Fatalf("expect an available tls connection, got error %v", err)
+	}
+}